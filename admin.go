@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// currentConfig holds the live MadnsConfig. handleDNS reads it on every
+// query; PUT /config swaps it atomically so a reload never drops the
+// UDP/TCP listeners or races a concurrent lookup.
+var currentConfig atomic.Pointer[MadnsConfig]
+
+// serveAdmin starts the optional admin HTTP API: config introspection and
+// hot reload, per-handler rebind state, recent queries, and metrics.
+func serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", adminAuth(handleAdminConfig))
+	mux.HandleFunc("/handlers/", adminAuth(handleAdminHandlers))
+	mux.HandleFunc("/queries", adminAuth(handleAdminQueries))
+	mux.HandleFunc("/metrics", adminAuth(handleAdminMetrics))
+
+	slog.Info("admin API listening on " + addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error(fmt.Sprintf("admin API failed: %v\n", err))
+	}
+}
+
+// adminAuth requires a matching "Authorization: Bearer <token>" header
+// whenever currentConfig's AdminAuthToken is non-empty; an empty token
+// leaves the API unauthenticated. The token is re-read from currentConfig
+// on every request so a PUT /config that rotates it takes effect
+// immediately, and compared in constant time to avoid a timing side channel.
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig.Load().AdminAuthToken
+		if token != "" {
+			got, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !hasBearer || len(got) != len(token) || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(redactedConfig(currentConfig.Load()))
+
+	case http.MethodPut:
+		var next MadnsConfig
+		if err := json.NewDecoder(r.Body).Decode(&next); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateConfig(&next); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		currentConfig.Store(&next)
+		slog.Info("config hot-reloaded via admin API")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// redactedConfig returns a copy of c with secrets masked, for GET /config.
+// PUT /config still round-trips the real values - only the admin API's own
+// read path is redacted, so a client that already knows a secret (or is
+// setting a new one) is unaffected.
+func redactedConfig(c *MadnsConfig) *MadnsConfig {
+	redacted := *c
+	if redacted.SMTPPassword != "" {
+		redacted.SMTPPassword = "[redacted]"
+	}
+	if redacted.AdminAuthToken != "" {
+		redacted.AdminAuthToken = "[redacted]"
+	}
+	return &redacted
+}
+
+// validateConfig sanity-checks a config before it's swapped in, so a bad
+// PUT /config can't take the resolver down.
+func validateConfig(c *MadnsConfig) error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if len(c.Handlers) == 0 {
+		return fmt.Errorf("config has no handlers")
+	}
+	return nil
+}
+
+// handleAdminHandlers serves GET /handlers/{name}/state and
+// POST /handlers/{name}/reset.
+func handleAdminHandlers(w http.ResponseWriter, r *http.Request) {
+	name, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/handlers/"), "/")
+	if !ok || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "state" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rebindHandlerState(name))
+
+	case action == "reset" && r.Method == http.MethodPost:
+		resetRebindState(name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleAdminQueries(w http.ResponseWriter, r *http.Request) {
+	since := time.Time{}
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queriesSince(since))
+}
+
+func handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, renderMetrics())
+}
@@ -12,8 +12,6 @@ import (
 	"strings"
 	"syscall"
 	"time"
-	"sync"
-	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
@@ -31,24 +29,93 @@ type MadnsConfig struct {
 
 	Port     int
 	Handlers map[string]MadnsSubConfig
+
+	// Multicast, if true, additionally binds 224.0.0.251:5353 so madns
+	// doubles as an mDNS responder on the local LAN.
+	Multicast bool
+
+	// BootstrapDNS, if set, is a plain "host:port" Do53 resolver used to
+	// resolve DoT/DoH/DoQ upstream hostnames, avoiding a chicken-and-egg
+	// loop when the system resolver can't be trusted or isn't available.
+	BootstrapDNS string
+
+	// AdminListen, if set, starts an HTTP admin/metrics API ("host:port")
+	// alongside the DNS listeners. See admin.go.
+	AdminListen string
+
+	// AdminAuthToken, if set, is required as a "Bearer <token>"
+	// Authorization header on every admin API request.
+	AdminAuthToken string
 }
 
+// mdnsMulticastAddr is the standard mDNS multicast group and port (RFC 6762).
+const mdnsMulticastAddr = "224.0.0.251:5353"
+
 // MadnsSubConfig - Structure for Subdomain portion of JSON config files
 type MadnsSubConfig struct {
 	Redirect    string
 	NotifyEmail string
 	Respond     string
+	Records     []MadnsRecord
 	NotifySlack string
 	Rebind	    *MadnsRebindConfig
+	Advertise   *MadnsAdvertiseConfig
+
+	// StripClientSubnet, if true, strips the edns-client-subnet option from
+	// the query before forwarding it in Redirect mode.
+	StripClientSubnet bool
+}
+
+// MadnsAdvertiseConfig - Structure for a DNS-SD / mDNS service advertisement (RFC 6763).
+// A query for ServiceType's PTR name returns a PTR to InstanceName, with SRV,
+// TXT, and A/AAAA glue for Host attached in the Extra section.
+type MadnsAdvertiseConfig struct {
+	InstanceName string
+	ServiceType  string // e.g. "_http._tcp.example.local."
+	Host         string // target hostname for the SRV record
+	Port         uint16
+	TXT          []string
+	IPv4         string
+	IPv6         string
+}
+
+// MadnsRecord - Structure for a single typed DNS record, for handlers that
+// need to hand out more than a bare A/AAAA/CNAME (TXT, MX, SRV, NS, PTR, CAA...)
+type MadnsRecord struct {
+	Type string // A, AAAA, CNAME, TXT, MX, SRV, NS, PTR, CAA
+	TTL  uint32
+
+	Value string // A, AAAA, CNAME, NS, PTR, TXT, CAA
+
+	// MX / SRV
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+
+	// CAA
+	Flag uint8
+	Tag  string
 }
 
 // MadnsRebindConfig - Rebind requires more data and I'd like to add strategies one day
 type MadnsRebindConfig struct {
 	Addrs []string
-}
 
-// Yes, big ugly global variable, but :shrug:
-var RebindMap sync.Map = sync.Map{}
+	// Strategy selects how successive queries map onto Addrs. Empty (or
+	// "round-robin") preserves the original one-shared-counter-per-handler
+	// behavior. See rebind.go for the rest.
+	Strategy string
+
+	// N is the strategy's threshold: a query count for
+	// "first-n-then-rest", or a number of seconds for "time-window".
+	N int
+
+	// TTL overrides the record TTL handed out for this handler, independent
+	// of Strategy. Rebind scenarios usually want this at 0 or 1 so the
+	// victim re-resolves quickly.
+	TTL uint32
+}
 
 func main() {
 
@@ -72,13 +139,23 @@ func main() {
 
 	listenString := ":" + strconv.Itoa(config.Port)
 
+	currentConfig.Store(&config)
+
 	dns.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
-		handleDNS(w, req, config)
+		handleDNS(w, req, *currentConfig.Load())
 	}) // pattern-matching of HandleFunc sucks, have to do our own
 
 	go serve("tcp", listenString)
 	go serve("udp", listenString)
 
+	if config.Multicast {
+		go serveMulticast(mdnsMulticastAddr)
+	}
+
+	if len(config.AdminListen) > 0 {
+		go serveAdmin(config.AdminListen)
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig)
 	signal.Ignore(syscall.SIGURG)
@@ -100,6 +177,96 @@ func serve(net, addr string) {
 	}
 }
 
+// serveMulticast joins the mDNS multicast group and serves using the same
+// handler registered via dns.HandleFunc in main().
+func serveMulticast(addr string) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to resolve mdns multicast address: %v\n", err))
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, udpAddr)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to join mdns multicast group %s: %v\n", addr, err))
+		return
+	}
+	server := &dns.Server{PacketConn: conn}
+	if err := server.ActivateAndServe(); err != nil {
+		slog.Error(fmt.Sprintf("mdns multicast server failed: %v\n", err))
+		os.Exit(1)
+	}
+}
+
+// finalizeReply echoes the client's EDNS0 OPT (so payload size, the DO bit,
+// and extended RCODEs round-trip) and sets TC if the reply won't fit in the
+// client's advertised (or default 512-byte) UDP buffer.
+func finalizeReply(w dns.ResponseWriter, req, m *dns.Msg) {
+	udpSize := uint16(dns.MinMsgSize)
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		if reqOpt.UDPSize() > udpSize {
+			udpSize = reqOpt.UDPSize()
+		}
+		// m may already carry its own OPT (e.g. handleRedirect handing us an
+		// upstream's raw reply) - update it in place rather than appending a
+		// second one, which would leave two OPT RRs in Extra.
+		if opt := m.IsEdns0(); opt != nil {
+			opt.SetUDPSize(udpSize)
+			opt.SetDo(reqOpt.Do())
+		} else {
+			m.SetEdns0(udpSize, reqOpt.Do())
+		}
+	}
+
+	if _, isTCP := w.RemoteAddr().(*net.TCPAddr); !isTCP {
+		m.Truncate(int(udpSize)) // trims RRs to fit and sets Truncated itself
+	}
+
+	w.WriteMsg(m)
+}
+
+// stripEDNSClientSubnet removes any edns-client-subnet option from m's OPT
+// record in place, leaving the rest of the OPT (UDP size, DO bit, etc) intact.
+func stripEDNSClientSubnet(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); ok {
+			continue
+		}
+		kept = append(kept, o)
+	}
+	opt.Option = kept
+}
+
+// ednsLogInfo renders a short summary of a request's EDNS0 metadata (UDP
+// buffer size, DO bit, ext-rcode, and any OPT options like Client Subnet or
+// Cookie) for inclusion in notification logs.
+func ednsLogInfo(req *dns.Msg) string {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return "edns: none"
+	}
+	parts := []string{
+		fmt.Sprintf("udpsize=%d", opt.UDPSize()),
+		fmt.Sprintf("do=%t", opt.Do()),
+		fmt.Sprintf("ext-rcode=%s", dns.RcodeToString[opt.ExtendedRcode()]),
+	}
+	for _, o := range opt.Option {
+		switch v := o.(type) {
+		case *dns.EDNS0_SUBNET:
+			parts = append(parts, fmt.Sprintf("ecs=%s/%d", v.Address, v.SourceNetmask))
+		case *dns.EDNS0_COOKIE:
+			parts = append(parts, "cookie="+v.Cookie)
+		default:
+			parts = append(parts, o.String())
+		}
+	}
+	return "edns: " + strings.Join(parts, " ")
+}
+
 func handleDNS(w dns.ResponseWriter, req *dns.Msg, config MadnsConfig) {
 
 	// DETERMINE WHICH CONFIG APPLIES
@@ -130,57 +297,88 @@ func handleDNS(w dns.ResponseWriter, req *dns.Msg, config MadnsConfig) {
 	}
 	if !processThis {
 		slog.Warn("no handler for domain: " + req.Question[0].Name)
-		m := new(dns.Msg)
-		m.SetReply(req)
-		m.SetRcode(req, dns.RcodeServerFailure)
-		w.WriteMsg(m)
+		iw := &instrumentedWriter{ResponseWriter: w}
+		servfail(iw, req)
+		recordQuery(queryRecord{Time: time.Now(), Source: clientIPFromAddr(w.RemoteAddr()),
+			Qname: req.Question[0].Name, Qtype: dns.TypeToString[req.Question[0].Qtype],
+			Handler: "-", Action: "no-handler", Rcode: rcodeString(iw)})
 		return // no subsequent handling
 	}
 
+	iw := &instrumentedWriter{ResponseWriter: w}
+	action := "none"
+
+	// Captured before dispatch: handleRedirect strips EDNS client-subnet from
+	// req in place when StripClientSubnet is set, which would otherwise erase
+	// it from the notification log below.
+	ednsInfo := ednsLogInfo(req)
+
 	// REDIRECT, if desired (mutually exclusive with RESPOND)
 	if len(c.Redirect) > 0 {
-		handleRedirect(w,req,c.Redirect)
+		action = "redirect"
+		handleRedirect(iw,req,ck,c.Redirect,c.StripClientSubnet,config.BootstrapDNS)
 	// RESPOND, if desired (mutually exclusive with REDIRECT)
+	} else if len(c.Records) > 0 {
+		action = "records"
+		handleRespondRecords(iw,req,c.Records)
 	} else if len(c.Respond) > 0 {
-		handleRespond(w,req,c.Respond)
+		action = "respond"
+		handleRespond(iw,req,c.Respond)
 	} else if c.Rebind != nil && len(c.Rebind.Addrs) > 0 {
-		rc := c.Rebind
-		// Do round robin on the list of addrs (but concurrently-safe)
-		ctrAny, _ := RebindMap.LoadOrStore(ck, &atomic.Uint64{})
-		ctr, _ := ctrAny.(*atomic.Uint64)
-		respond := rc.Addrs[(ctr.Add(1) - 1) % uint64(len(rc.Addrs))] // We want the pre-increment value, hence -1
-		handleRespond(w,req,respond)
+		action = "rebind"
+		clientIP := clientIPFromAddr(w.RemoteAddr())
+		respond := pickRebindAddr(ck, c.Rebind, req.Question[0].Name, clientIP)
+		handleRespondTTL(iw,req,respond,c.Rebind.TTL)
+	} else if c.Advertise != nil {
+		action = "advertise"
+		handleAdvertise(iw,req,c.Advertise)
 	}
 
+	recordQuery(queryRecord{Time: time.Now(), Source: clientIPFromAddr(w.RemoteAddr()),
+		Qname: req.Question[0].Name, Qtype: dns.TypeToString[req.Question[0].Qtype],
+		Handler: ck, Action: action, Rcode: rcodeString(iw)})
+
 	body := "source: " + w.RemoteAddr().String() + "\n" +
 		"proto: " + w.RemoteAddr().Network() + "\n" +
+		ednsInfo + "\n" +
 		"request:\n" + req.String() + "\n\n"
 
 	// EMAIL NOTIFICATION, if directed
 	if len(c.NotifyEmail) > 0 {
 		debouncedSendEmail(c.NotifyEmail, body, config)
+		notifyCounters.inc(ck, "email", "attempted") // these helpers don't surface success/failure, so this can't be "sent"
 	}
 
 	// Slack Notification, if directed
 	if len(c.NotifySlack) > 0 {
 		sendSlackMessage(c.NotifySlack, body)
+		notifyCounters.inc(ck, "slack", "attempted") // ditto
 	}
 }
 
-func handleRedirect(w dns.ResponseWriter, req *dns.Msg, redirect string) {
-	dnsClient := &dns.Client{Net: "udp", ReadTimeout: 4 * time.Second, WriteTimeout: 4 * time.Second, SingleInflight: true}
-	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
-		dnsClient.Net = "tcp"
+func handleRedirect(w dns.ResponseWriter, req *dns.Msg, handler, redirect string, stripClientSubnet bool, bootstrapDNS string) {
+	if stripClientSubnet {
+		stripEDNSClientSubnet(req)
+	}
+
+	_, preferTCP := w.RemoteAddr().(*net.TCPAddr)
+	upstream, err := getUpstream(redirect, bootstrapDNS, preferTCP)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to set up upstream %q: %v\n", redirect, err))
+		servfail(w, req)
+		return
 	}
 
-	slog.Info("redirecting using protocol: " + dnsClient.Net)
+	slog.Info("redirecting to upstream: " + redirect)
 
 	retries := 1
 	retry:
-	r, _, err := dnsClient.Exchange(req, redirect)
+	start := time.Now()
+	r, err := upstream.Exchange(req)
+	upstreamLatency.observe(handler, time.Since(start).Seconds())
 	if err == nil {
 		r.Compress = true
-		w.WriteMsg(r)
+		finalizeReply(w, req, r)
 	} else {
 		if retries > 0 {
 			retries--
@@ -188,15 +386,27 @@ func handleRedirect(w dns.ResponseWriter, req *dns.Msg, redirect string) {
 			goto retry
 		} else {
 			slog.Warn(fmt.Sprintf("failure to forward request %q\n", err))
-			m := new(dns.Msg)
-			m.SetReply(req)
-			m.SetRcode(req, dns.RcodeServerFailure)
-			w.WriteMsg(m)
+			servfail(w, req)
 		}
 	}
 }
 
+// servfail replies to req with SERVFAIL, still honoring EDNS0.
+func servfail(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	finalizeReply(w, req, m)
+}
+
 func handleRespond(w dns.ResponseWriter, req *dns.Msg, respond string) {
+	handleRespondTTL(w, req, respond, 0)
+}
+
+// handleRespondTTL is handleRespond with a configurable record TTL, for
+// callers (like Rebind, via MadnsRebindConfig.TTL) that need something other
+// than the default 0.
+func handleRespondTTL(w dns.ResponseWriter, req *dns.Msg, respond string, ttl uint32) {
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.SetRcode(req, dns.RcodeSuccess)
@@ -210,24 +420,184 @@ func handleRespond(w dns.ResponseWriter, req *dns.Msg, respond string) {
 			// This is not a valid IP address, so assume it's a CNAME
 			rr := new(dns.CNAME)
 			rr.Hdr = dns.RR_Header{Name: req.Question[i].Name,
-			Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 0}
+			Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
 			rr.Target = strings.TrimSuffix(respond, ".") + "."
 			m.Answer[i] = rr
 		} else if ip.To4() == nil {
 			// This is an IPv6 address, so do a AAAA record
 			rr := new(dns.AAAA)
 			rr.Hdr = dns.RR_Header{Name: req.Question[i].Name,
-			Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 0}
+			Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
 			rr.AAAA = ip
 			m.Answer[i] = rr
 		} else {
 			// This is an IPv4 address, so do an A record
 			rr := new(dns.A)
 			rr.Hdr = dns.RR_Header{Name: req.Question[i].Name,
-			Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}
+			Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
 			rr.A = ip
 			m.Answer[i] = rr
 		}
 	}
-	w.WriteMsg(m)
+	finalizeReply(w, req, m)
+}
+
+// handleRespondRecords answers a question from a list of typed records,
+// filtering to the ones matching the question's qtype. If none match, we
+// still return NOERROR with an empty answer section (NODATA) rather than
+// NXDOMAIN, since the handler itself matched the name.
+func handleRespondRecords(w dns.ResponseWriter, req *dns.Msg, records []MadnsRecord) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetRcode(req, dns.RcodeSuccess)
+
+	name := req.Question[0].Name
+	qtype := req.Question[0].Qtype
+
+	for _, rec := range records {
+		rrtype, ok := dns.StringToType[strings.ToUpper(rec.Type)]
+		if !ok {
+			slog.Warn("unknown record type in config: " + rec.Type)
+			continue
+		}
+		if rrtype != qtype {
+			continue
+		}
+		rr, err := buildRR(name, rec)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("skipping record for %s: %v", name, err))
+			continue
+		}
+		slog.Info("Responding to " + name + " with " + rec.Type + " record")
+		m.Answer = append(m.Answer, rr)
+	}
+	finalizeReply(w, req, m)
+}
+
+// buildRR turns a MadnsRecord config entry into a dns.RR of the requested type.
+func buildRR(name string, rec MadnsRecord) (dns.RR, error) {
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: rec.TTL}
+
+	switch strings.ToUpper(rec.Type) {
+	case "A":
+		ip := net.ParseIP(rec.Value)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q for A record", rec.Value)
+		}
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip}, nil
+	case "AAAA":
+		ip := net.ParseIP(rec.Value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q for AAAA record", rec.Value)
+		}
+		hdr.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+	case "CNAME":
+		hdr.Rrtype = dns.TypeCNAME
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(rec.Value)}, nil
+	case "NS":
+		hdr.Rrtype = dns.TypeNS
+		return &dns.NS{Hdr: hdr, Ns: dns.Fqdn(rec.Value)}, nil
+	case "PTR":
+		hdr.Rrtype = dns.TypePTR
+		return &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(rec.Value)}, nil
+	case "TXT":
+		hdr.Rrtype = dns.TypeTXT
+		return &dns.TXT{Hdr: hdr, Txt: []string{rec.Value}}, nil
+	case "MX":
+		hdr.Rrtype = dns.TypeMX
+		return &dns.MX{Hdr: hdr, Preference: rec.Priority, Mx: dns.Fqdn(rec.Target)}, nil
+	case "SRV":
+		hdr.Rrtype = dns.TypeSRV
+		return &dns.SRV{Hdr: hdr, Priority: rec.Priority, Weight: rec.Weight,
+			Port: rec.Port, Target: dns.Fqdn(rec.Target)}, nil
+	case "CAA":
+		hdr.Rrtype = dns.TypeCAA
+		return &dns.CAA{Hdr: hdr, Flag: rec.Flag, Tag: rec.Tag, Value: rec.Value}, nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", rec.Type)
+	}
+}
+
+// handleAdvertise answers a DNS-SD (RFC 6763) query for the service type
+// with a PTR to the advertised instance plus SRV/TXT/A/AAAA glue in Extra,
+// and also answers direct SRV/TXT/A/AAAA queries against the instance or
+// host name, for clients that don't rely on the cached glue.
+func handleAdvertise(w dns.ResponseWriter, req *dns.Msg, adv *MadnsAdvertiseConfig) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetRcode(req, dns.RcodeSuccess)
+
+	q := req.Question[0]
+	qname := strings.ToLower(q.Name)
+
+	serviceType := dns.Fqdn(adv.ServiceType)
+	instance := dns.Fqdn(adv.InstanceName + "." + strings.TrimSuffix(serviceType, "."))
+	target := dns.Fqdn(adv.Host)
+
+	switch {
+	case qname == strings.ToLower(serviceType):
+		if q.Qtype != dns.TypePTR {
+			break
+		}
+		slog.Info("Advertising " + instance + " for " + serviceType)
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+			Ptr: instance,
+		})
+		m.Extra = append(m.Extra, advertiseSRV(instance, adv, target))
+		if txt := advertiseTXT(instance, adv.TXT); txt != nil {
+			m.Extra = append(m.Extra, txt)
+		}
+		m.Extra = append(m.Extra, advertiseGlue(target, adv)...)
+
+	case qname == strings.ToLower(instance):
+		switch q.Qtype {
+		case dns.TypeSRV:
+			m.Answer = append(m.Answer, advertiseSRV(q.Name, adv, target))
+		case dns.TypeTXT:
+			if txt := advertiseTXT(q.Name, adv.TXT); txt != nil {
+				m.Answer = append(m.Answer, txt)
+			}
+		}
+
+	case qname == strings.ToLower(target):
+		for _, rr := range advertiseGlue(q.Name, adv) {
+			if rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+
+	finalizeReply(w, req, m)
+}
+
+func advertiseSRV(name string, adv *MadnsAdvertiseConfig, target string) *dns.SRV {
+	return &dns.SRV{
+		Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+		Priority: 0, Weight: 0, Port: adv.Port, Target: target,
+	}
+}
+
+func advertiseTXT(name string, txt []string) *dns.TXT {
+	if len(txt) == 0 {
+		return nil
+	}
+	return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120}, Txt: txt}
+}
+
+func advertiseGlue(name string, adv *MadnsAdvertiseConfig) []dns.RR {
+	var glue []dns.RR
+	if len(adv.IPv4) > 0 {
+		if ip := net.ParseIP(adv.IPv4); ip != nil && ip.To4() != nil {
+			glue = append(glue, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: ip.To4()})
+		}
+	}
+	if len(adv.IPv6) > 0 {
+		if ip := net.ParseIP(adv.IPv6); ip != nil {
+			glue = append(glue, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 120}, AAAA: ip})
+		}
+	}
+	return glue
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// instrumentedWriter wraps a dns.ResponseWriter to capture the Rcode of
+// whatever message a handler ends up writing, so handleDNS can log it
+// without every handler returning extra values.
+type instrumentedWriter struct {
+	dns.ResponseWriter
+	rcode int
+	wrote bool
+}
+
+func (iw *instrumentedWriter) WriteMsg(m *dns.Msg) error {
+	iw.rcode = m.Rcode
+	iw.wrote = true
+	return iw.ResponseWriter.WriteMsg(m)
+}
+
+func rcodeString(iw *instrumentedWriter) string {
+	if !iw.wrote {
+		return "-"
+	}
+	return dns.RcodeToString[iw.rcode]
+}
+
+// queryRecord is one entry in the admin API's recent-queries log.
+type queryRecord struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Qname   string    `json:"qname"`
+	Qtype   string    `json:"qtype"`
+	Handler string    `json:"handler"`
+	Action  string    `json:"action"`
+	Rcode   string    `json:"rcode"`
+}
+
+// maxRecentQueries bounds the in-memory ring buffer backing GET /queries.
+const maxRecentQueries = 1000
+
+var recentQueries struct {
+	mu      sync.Mutex
+	entries []queryRecord
+}
+
+// recordQuery appends rec to the recent-queries log and bumps the
+// query-count metric for its (handler, qtype, rcode) label tuple.
+func recordQuery(rec queryRecord) {
+	recentQueries.mu.Lock()
+	recentQueries.entries = append(recentQueries.entries, rec)
+	if len(recentQueries.entries) > maxRecentQueries {
+		recentQueries.entries = recentQueries.entries[len(recentQueries.entries)-maxRecentQueries:]
+	}
+	recentQueries.mu.Unlock()
+
+	queryCounters.inc(rec.Handler, rec.Qtype, rec.Rcode)
+}
+
+// queriesSince returns recorded queries strictly after since (the zero Time
+// returns everything).
+func queriesSince(since time.Time) []queryRecord {
+	recentQueries.mu.Lock()
+	defer recentQueries.mu.Unlock()
+
+	out := make([]queryRecord, 0, len(recentQueries.entries))
+	for _, r := range recentQueries.entries {
+		if r.Time.After(since) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// labelCounters is a minimal Prometheus-style counter vector: one uint64
+// per label tuple, joined into a map key.
+type labelCounters struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newLabelCounters() *labelCounters {
+	return &labelCounters{counts: make(map[string]uint64)}
+}
+
+func (c *labelCounters) inc(labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[strings.Join(labels, "\x1f")]++
+}
+
+func (c *labelCounters) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
+
+var (
+	queryCounters  = newLabelCounters() // handler, qtype, rcode
+	notifyCounters = newLabelCounters() // handler, channel (email/slack), result
+)
+
+// latencyHistogram is a minimal fixed-bucket histogram, keyed by a single
+// label (the handler name) - just enough to emit Prometheus's text
+// exposition format without pulling in a metrics library.
+type latencyHistogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, seconds, ascending
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+func newLatencyHistogram(buckets []float64) *latencyHistogram {
+	return &latencyHistogram{
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+}
+
+func (h *latencyHistogram) observe(label string, seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts, ok := h.counts[label]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[label] = counts
+	}
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			counts[i]++
+		}
+	}
+	h.sums[label] += seconds
+	h.totals[label]++
+}
+
+// upstreamLatency tracks handleRedirect's Exchange latency, by handler.
+var upstreamLatency = newLatencyHistogram([]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5})
+
+// renderMetrics renders every counter/histogram in Prometheus text format.
+func renderMetrics() string {
+	var b strings.Builder
+
+	writeCounterSection(&b, "madns_queries_total", "DNS queries handled, by handler/qtype/rcode",
+		[]string{"handler", "qtype", "rcode"}, queryCounters.snapshot())
+	writeCounterSection(&b, "madns_notifications_total", "Notification attempts, by handler/channel/result",
+		[]string{"handler", "channel", "result"}, notifyCounters.snapshot())
+	writeHistogramSection(&b, "madns_upstream_latency_seconds", "Redirect upstream Exchange latency, by handler", upstreamLatency)
+
+	return b.String()
+}
+
+func writeCounterSection(b *strings.Builder, name, help string, labelNames []string, counts map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, k := range sortedKeys(counts) {
+		fmt.Fprintf(b, "%s{%s} %d\n", name, labelPairs(labelNames, strings.Split(k, "\x1f")), counts[k])
+	}
+}
+
+func writeHistogramSection(b *strings.Builder, name, help string, h *latencyHistogram) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	labels := make([]string, 0, len(h.counts))
+	for l := range h.counts {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		counts := h.counts[label]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket{handler=%q,le=%q} %d\n", name, label, fmt.Sprintf("%g", bound), counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{handler=%q,le=\"+Inf\"} %d\n", name, label, h.totals[label])
+		fmt.Fprintf(b, "%s_sum{handler=%q} %g\n", name, label, h.sums[label])
+		fmt.Fprintf(b, "%s_count{handler=%q} %d\n", name, label, h.totals[label])
+	}
+}
+
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", n, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
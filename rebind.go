@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rebindKey identifies one piece of rebind state. Not every strategy uses
+// every field: shared round-robin keys on handler alone, per-source and
+// first-n-then-rest add clientIP, and time-window keys on qname instead.
+type rebindKey struct {
+	handler  string
+	qname    string
+	clientIP string
+}
+
+// rebindState is the counter/clock pair backing a single rebindKey.
+type rebindState struct {
+	counter    atomic.Uint64
+	firstSeen  time.Time
+	lastAccess atomic.Int64 // unix seconds, refreshed on every hit; drives GC
+}
+
+// rebindStates holds all live rebind state, keyed by rebindKey. Entries idle
+// longer than rebindStateTTL are reclaimed by gcRebindStates so a
+// long-running instance doesn't leak state for clients/qnames that stop
+// showing up.
+var rebindStates sync.Map // rebindKey -> *rebindState
+
+const rebindStateTTL = 30 * time.Minute
+const rebindGCInterval = 5 * time.Minute
+
+func init() {
+	go func() {
+		for range time.Tick(rebindGCInterval) {
+			gcRebindStates()
+		}
+	}()
+}
+
+func gcRebindStates() {
+	cutoff := time.Now().Add(-rebindStateTTL).Unix()
+	rebindStates.Range(func(k, v any) bool {
+		if v.(*rebindState).lastAccess.Load() < cutoff {
+			rebindStates.Delete(k)
+		}
+		return true
+	})
+}
+
+func loadRebindState(key rebindKey) *rebindState {
+	actual, _ := rebindStates.LoadOrStore(key, &rebindState{firstSeen: time.Now()})
+	st := actual.(*rebindState)
+	st.lastAccess.Store(time.Now().Unix())
+	return st
+}
+
+// rebindClientState is the admin API's view of one key's rebind state.
+type rebindClientState struct {
+	ClientIP   string    `json:"clientIP,omitempty"`
+	Qname      string    `json:"qname,omitempty"`
+	Counter    uint64    `json:"counter"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+// rebindHandlerSnapshot is the admin API's view of a handler's rebind state.
+type rebindHandlerSnapshot struct {
+	Handler string              `json:"handler"`
+	Clients []rebindClientState `json:"clients"`
+}
+
+// rebindHandlerState returns the current rebind counters and last-seen
+// clients/qnames for the handler named name, for GET /handlers/{name}/state.
+func rebindHandlerState(name string) rebindHandlerSnapshot {
+	snap := rebindHandlerSnapshot{Handler: name, Clients: []rebindClientState{}}
+	rebindStates.Range(func(k, v any) bool {
+		key := k.(rebindKey)
+		if key.handler != name {
+			return true
+		}
+		st := v.(*rebindState)
+		snap.Clients = append(snap.Clients, rebindClientState{
+			ClientIP:   key.clientIP,
+			Qname:      key.qname,
+			Counter:    st.counter.Load(),
+			LastAccess: time.Unix(st.lastAccess.Load(), 0),
+		})
+		return true
+	})
+	return snap
+}
+
+// resetRebindState clears all rebind counters for the handler named name,
+// for POST /handlers/{name}/reset.
+func resetRebindState(name string) {
+	rebindStates.Range(func(k, v any) bool {
+		if k.(rebindKey).handler == name {
+			rebindStates.Delete(k)
+		}
+		return true
+	})
+}
+
+// clientIPFromAddr pulls the bare IP (no port) out of a dns.ResponseWriter's
+// RemoteAddr, which is either a *net.UDPAddr or a *net.TCPAddr.
+func clientIPFromAddr(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		return host
+	}
+}
+
+// pickRebindAddr selects which of rc.Addrs to hand out for this query,
+// according to rc.Strategy. ck identifies the handler (for state keying),
+// qname is the question name, and clientIP is the querying source's address.
+func pickRebindAddr(ck string, rc *MadnsRebindConfig, qname, clientIP string) string {
+	if len(rc.Addrs) == 1 {
+		return rc.Addrs[0]
+	}
+
+	threshold := rc.N
+	if threshold <= 0 {
+		threshold = 1
+	}
+
+	switch rc.Strategy {
+	case "first-n-then-rest":
+		// Classic rebind primitive: the first N queries from a source get
+		// Addrs[0], then it's switched to Addrs[1] for good.
+		st := loadRebindState(rebindKey{handler: ck, clientIP: clientIP})
+		if st.counter.Add(1) <= uint64(threshold) {
+			return rc.Addrs[0]
+		}
+		return rc.Addrs[1]
+
+	case "time-window":
+		// Addrs[0] for the first N seconds a qname has been seen, then
+		// Addrs[1] - independent of which client is asking.
+		st := loadRebindState(rebindKey{handler: ck, qname: qname})
+		if time.Since(st.firstSeen) < time.Duration(threshold)*time.Second {
+			return rc.Addrs[0]
+		}
+		return rc.Addrs[1]
+
+	case "per-source":
+		// Round robin over Addrs, but with independent state per client IP
+		// so parallel victims don't desync each other's rebind sequence.
+		st := loadRebindState(rebindKey{handler: ck, clientIP: clientIP})
+		idx := (st.counter.Add(1) - 1) % uint64(len(rc.Addrs))
+		return rc.Addrs[idx]
+
+	default:
+		// "round-robin" or unset: one shared counter per handler, as before.
+		// (TTL is applied unconditionally via rc.TTL regardless of
+		// Strategy, so there's no separate "low-ttl" strategy to select.)
+		st := loadRebindState(rebindKey{handler: ck})
+		idx := (st.counter.Add(1) - 1) % uint64(len(rc.Addrs))
+		return rc.Addrs[idx]
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Upstream resolves a single DNS query against a configured upstream
+// resolver. Implementations may hold onto long-lived connections/clients,
+// so an Upstream should be reused across queries rather than recreated.
+type Upstream interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+}
+
+// upstreamCache holds one Upstream per Redirect string so DoT/DoH/DoQ
+// upstreams reuse their TLS session, HTTP/2 client, or QUIC connection
+// instead of paying handshake cost on every query.
+var upstreamCache sync.Map
+
+// getUpstream returns the Upstream for redirect, parsing it as a URL to pick
+// a transport: "tls://host:port" for DoT, "https://host/path" for DoH,
+// "quic://host:port" for DoQ, and a bare "host:port" for classic Do53. A URL
+// with any other scheme is an error. Classic upstreams are cheap and depend on the client's own
+// transport, so they're built fresh rather than cached.
+func getUpstream(redirect string, bootstrapDNS string, preferTCP bool) (Upstream, error) {
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return &classicUpstream{addr: redirect, preferTCP: preferTCP}, nil
+	}
+
+	if cached, ok := upstreamCache.Load(redirect); ok {
+		return cached.(Upstream), nil
+	}
+
+	upstream, err := newEncryptedUpstream(u, bootstrapDNS)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := upstreamCache.LoadOrStore(redirect, upstream)
+	return actual.(Upstream), nil
+}
+
+func newEncryptedUpstream(u *url.URL, bootstrapDNS string) (Upstream, error) {
+	switch u.Scheme {
+	case "tls":
+		return newDoTUpstream(u.Host, bootstrapDNS)
+	case "https":
+		return newDoHUpstream(u, bootstrapDNS)
+	case "quic":
+		return newDoQUpstream(u.Host, bootstrapDNS)
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+}
+
+// bootstrapLookupIP resolves host to an IP address using bootstrapDNS,
+// avoiding a chicken-and-egg loop when the upstream itself is named by
+// hostname. If host is already a literal IP, or no bootstrap resolver is
+// configured, host is returned unchanged.
+func bootstrapLookupIP(host string, bootstrapDNS string) (string, error) {
+	if net.ParseIP(host) != nil || bootstrapDNS == "" {
+		return host, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	c := &dns.Client{Net: "udp", ReadTimeout: 4 * time.Second, WriteTimeout: 4 * time.Second}
+	r, _, err := c.Exchange(m, bootstrapDNS)
+	if err != nil {
+		return "", fmt.Errorf("bootstrap lookup of %s via %s failed: %w", host, bootstrapDNS, err)
+	}
+	for _, ans := range r.Answer {
+		if a, ok := ans.(*dns.A); ok {
+			return a.A.String(), nil
+		}
+	}
+	return "", fmt.Errorf("bootstrap lookup of %s via %s returned no A records", host, bootstrapDNS)
+}
+
+// classicUpstream forwards over plain Do53, matching whichever of UDP/TCP
+// the original client used.
+type classicUpstream struct {
+	addr      string
+	preferTCP bool
+}
+
+func (u *classicUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: "udp", ReadTimeout: 4 * time.Second, WriteTimeout: 4 * time.Second, SingleInflight: true}
+	if u.preferTCP {
+		c.Net = "tcp"
+	}
+	r, _, err := c.Exchange(req, u.addr)
+	return r, err
+}
+
+// dotUpstream forwards over DNS-over-TLS (RFC 7858), keeping one TLS
+// connection open and serializing queries over it.
+type dotUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *dns.Conn
+}
+
+func newDoTUpstream(hostport string, bootstrapDNS string) (*dotUpstream, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "853"
+	}
+	ip, err := bootstrapLookupIP(host, bootstrapDNS)
+	if err != nil {
+		return nil, err
+	}
+	return &dotUpstream{
+		addr:      net.JoinHostPort(ip, port),
+		tlsConfig: &tls.Config{ServerName: host},
+	}, nil
+}
+
+func (u *dotUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		conn, err := dns.DialTimeoutWithTLS("tcp", u.addr, u.tlsConfig, 4*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		u.conn = conn
+	}
+
+	u.conn.SetDeadline(time.Now().Add(4 * time.Second))
+	if err := u.conn.WriteMsg(req); err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, err
+	}
+	r, err := u.conn.ReadMsg()
+	if err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, err
+	}
+	return r, nil
+}
+
+// dohUpstream forwards over DNS-over-HTTPS (RFC 8484) using the POST form
+// with an "application/dns-message" body, reusing one HTTP/2 client.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(u *url.URL, bootstrapDNS string) (*dohUpstream, error) {
+	host := u.Hostname()
+	ip, err := bootstrapLookupIP(host, bootstrapDNS)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 4 * time.Second}
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{ServerName: host},
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		},
+	}
+
+	return &dohUpstream{
+		url:    u.String(),
+		client: &http.Client{Transport: transport, Timeout: 4 * time.Second},
+	}, nil
+}
+
+func (u *dohUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream %s returned %s", u.url, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// doqUpstream forwards over DNS-over-QUIC (RFC 9250), keeping one QUIC
+// connection open and opening a fresh bidirectional stream per query.
+type doqUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+func newDoQUpstream(hostport string, bootstrapDNS string) (*doqUpstream, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "853"
+	}
+	ip, err := bootstrapLookupIP(host, bootstrapDNS)
+	if err != nil {
+		return nil, err
+	}
+	return &doqUpstream{
+		addr:      net.JoinHostPort(ip, port),
+		tlsConfig: &tls.Config{ServerName: host, NextProtos: []string{"doq"}},
+	}, nil
+}
+
+func (u *doqUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		u.mu.Lock()
+		u.conn = nil
+		u.mu.Unlock()
+		return nil, err
+	}
+	defer stream.Close()
+
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 9250 section 4.2.1: each DoQ message is prefixed with its length,
+	// just like DNS over TCP.
+	lenPrefixed := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(lenPrefixed, uint16(len(packed)))
+	copy(lenPrefixed[2:], packed)
+	if _, err := stream.Write(lenPrefixed); err != nil {
+		return nil, err
+	}
+
+	var respLen uint16
+	if err := binary.Read(stream, binary.BigEndian, &respLen); err != nil {
+		return nil, err
+	}
+	respBuf := make([]byte, respLen)
+	if _, err := io.ReadFull(stream, respBuf); err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(respBuf); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (u *doqUpstream) getConn() (*quic.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil {
+		return u.conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, u.addr, u.tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	u.conn = conn
+	return conn, nil
+}